@@ -0,0 +1,297 @@
+package rados
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/sync/singleflight"
+
+	datastore "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// defaultCacheSize is used by NewCachedDatastore when opts.Size is zero.
+const defaultCacheSize = 4096
+
+// CacheOptions configures NewCachedDatastore.
+type CacheOptions struct {
+	// Size is the maximum number of keys held in the LRU. Zero uses
+	// defaultCacheSize.
+	Size int
+
+	// TTL bounds how long a cached Get/Has result is trusted before the
+	// next lookup falls through to the wrapped Datastore. Zero means
+	// entries never expire on their own (they still get evicted for
+	// space, and invalidated by local Put/Delete).
+	TTL time.Duration
+
+	// NegativeTTL bounds how long a "key not found" result is cached.
+	// Zero disables negative caching: every miss reaches the wrapped
+	// Datastore, though concurrent misses for the same key are still
+	// coalesced into a single call.
+	NegativeTTL time.Duration
+}
+
+// CachedDatastore wraps a datastore.Datastore with an in-process read cache
+// and request coalescer. RADOS round trips dominate small-object workloads
+// (IPFS headers, pins, provider records), so serving hot Get/Has results
+// from RAM and deduplicating concurrent lookups for the same key cuts
+// cluster load meaningfully. Query and Sync pass straight through
+// uncached; Batch also passes through, so writes made via a Batch are not
+// reflected in the cache until the keys' cached entries expire, are
+// evicted, or are invalidated by a direct Put/Delete.
+type CachedDatastore struct {
+	inner datastore.Datastore
+	opts  CacheOptions
+	cache *lru.Cache
+
+	// genMu guards nextGen and gen, and serializes them against the cache
+	// itself: a Get/Has only ever writes its result into the cache while
+	// holding genMu and finding the key's generation unchanged from when it
+	// started (see currentGen/storeIfCurrent), and a Put/Delete only ever
+	// assigns a fresh generation and evicts the key while holding the same
+	// lock (see invalidate). That shared lock is what stops a Get/Has that
+	// raced a concurrent Put/Delete from writing its now-stale result into
+	// the cache after the invalidation it raced against has already run:
+	// nextGen only ever increases, so no generation value is ever assigned
+	// twice, even for a key whose gen entry has aged out of gen's own bound
+	// below and gets recreated later.
+	genMu   sync.Mutex
+	nextGen uint64
+	// gen tracks each key's last-assigned generation, own-bounded by the
+	// same Size as cache (rather than piggybacking on cache's eviction) so
+	// it can't grow without bound for a write-heavy workload whose keys are
+	// Put/Deleted but never read back, and so never added to (or evicted
+	// from) cache itself.
+	gen *lru.Cache
+
+	getGroup singleflight.Group
+	hasGroup singleflight.Group
+	putGroup singleflight.Group
+}
+
+var _ datastore.Datastore = (*CachedDatastore)(nil)
+var _ datastore.Batching = (*CachedDatastore)(nil)
+
+// cacheEntry is what gets stored in the LRU for a key. err is either nil
+// (the key exists) or datastore.ErrNotFound (a negative cache hit); any
+// other error is never cached. value is only meaningful when valueLoaded
+// is true, i.e. it was populated by Get rather than Has.
+type cacheEntry struct {
+	err         error
+	value       []byte
+	valueLoaded bool
+	expires     time.Time // zero means "does not expire"
+}
+
+func (e *cacheEntry) expired() bool {
+	return !e.expires.IsZero() && time.Now().After(e.expires)
+}
+
+// NewCachedDatastore wraps inner with a read cache and coalescer
+// configured by opts.
+func NewCachedDatastore(inner datastore.Datastore, opts CacheOptions) (*CachedDatastore, error) {
+	size := opts.Size
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	gen, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &CachedDatastore{inner: inner, opts: opts, cache: cache, gen: gen}, nil
+}
+
+// currentGen returns k's current generation, or 0 if k has no live gen
+// entry — either because it's never been invalidated, or because its entry
+// aged out of gen's own bound. Whenever it finds no entry it also plants a
+// baseline 0 entry for k, so storeIfCurrent below can tell "confirmed unchanged"
+// apart from "aged out, can't tell" instead of treating every absence as a
+// match. Get/Has call this before issuing their inner fetch, to snapshot a
+// baseline they can later compare against to detect a concurrent
+// Put/Delete.
+func (cds *CachedDatastore) currentGen(k string) uint64 {
+	cds.genMu.Lock()
+	defer cds.genMu.Unlock()
+	if v, ok := cds.gen.Get(k); ok {
+		return v.(uint64)
+	}
+	cds.gen.Add(k, uint64(0))
+	return 0
+}
+
+// storeIfCurrent adds entry to the cache only if k's generation still
+// matches gen, i.e. no Put/Delete for k has run since the caller snapshot
+// gen via currentGen. Otherwise the fetch that produced entry either raced
+// a concurrent write, or k's gen entry aged out of gen's own bound in the
+// meantime and there's no way to confirm it didn't race one — either way
+// it's dropped instead of cached.
+func (cds *CachedDatastore) storeIfCurrent(k string, gen uint64, entry *cacheEntry) {
+	cds.genMu.Lock()
+	defer cds.genMu.Unlock()
+	if v, ok := cds.gen.Get(k); ok && v.(uint64) == gen {
+		cds.cache.Add(k, entry)
+	}
+}
+
+// invalidate assigns k a fresh generation, never before used by any key,
+// and evicts it from the cache. Both happen under genMu, the same lock
+// storeIfCurrent checks under, so a Get/Has that's mid-flight when
+// Put/Delete calls this can never write its stale result back in
+// afterward — even if k's previous gen entry has since aged out of gen's
+// own bound, nextGen having strictly increased means this call's value can
+// never equal whatever gen a mid-flight Get/Has snapshotted earlier.
+func (cds *CachedDatastore) invalidate(k string) {
+	cds.genMu.Lock()
+	defer cds.genMu.Unlock()
+	cds.nextGen++
+	cds.gen.Add(k, cds.nextGen)
+	cds.cache.Remove(k)
+}
+
+// expiryFor returns the expiry deadline to store alongside a cached result,
+// using TTL for a hit and NegativeTTL for a miss. A zero result means the
+// entry should not expire on its own.
+func (cds *CachedDatastore) expiryFor(found bool) time.Time {
+	d := cds.opts.TTL
+	if !found {
+		d = cds.opts.NegativeTTL
+	}
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+func (cds *CachedDatastore) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	k := key.String()
+	if v, ok := cds.cache.Get(k); ok {
+		if e := v.(*cacheEntry); e.valueLoaded && !e.expired() {
+			return e.value, e.err
+		}
+	}
+
+	// Snapshot k's generation before the fetch, so the result is only
+	// cached below if no concurrent Put/Delete invalidated k while the
+	// fetch was in flight.
+	gen := cds.currentGen(k)
+
+	// Coalesce concurrent Gets for the same key into one inner call; every
+	// waiter shares the leader's context, so a waiter's own cancellation
+	// neither stops the in-flight call nor ends its own wait on it.
+	v, err, _ := cds.getGroup.Do(k, func() (interface{}, error) {
+		value, ierr := cds.inner.Get(ctx, key)
+		if ierr != nil && ierr != datastore.ErrNotFound {
+			return nil, ierr
+		}
+		found := ierr == nil
+		if found || cds.opts.NegativeTTL > 0 {
+			cds.storeIfCurrent(k, gen, &cacheEntry{value: value, err: ierr, valueLoaded: true, expires: cds.expiryFor(found)})
+		}
+		return value, ierr
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+func (cds *CachedDatastore) Has(ctx context.Context, key datastore.Key) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	k := key.String()
+	if v, ok := cds.cache.Get(k); ok {
+		if e := v.(*cacheEntry); !e.expired() {
+			return e.err == nil, nil
+		}
+	}
+
+	gen := cds.currentGen(k)
+	v, err, _ := cds.hasGroup.Do(k, func() (interface{}, error) {
+		exists, ierr := cds.inner.Has(ctx, key)
+		if ierr != nil {
+			return false, ierr
+		}
+		if exists || cds.opts.NegativeTTL > 0 {
+			entry := &cacheEntry{expires: cds.expiryFor(exists)}
+			if !exists {
+				entry.err = datastore.ErrNotFound
+			}
+			cds.storeIfCurrent(k, gen, entry)
+		}
+		return exists, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return v.(bool), nil
+}
+
+func (cds *CachedDatastore) GetSize(ctx context.Context, key datastore.Key) (int, error) {
+	return cds.inner.GetSize(ctx, key)
+}
+
+// Put coalesces concurrent Puts of the same key and value into a single
+// inner call (the value is part of the coalescing key, so two callers
+// racing to write different values for the same key are never merged into
+// one write that silently drops one of them), then invalidates any cached
+// entry so the next read observes the new value.
+func (cds *CachedDatastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	k := key.String()
+	_, err, _ := cds.putGroup.Do(k+"\x00"+string(value), func() (interface{}, error) {
+		return nil, cds.inner.Put(ctx, key, value)
+	})
+	if err != nil {
+		return err
+	}
+	cds.invalidate(k)
+	return nil
+}
+
+func (cds *CachedDatastore) Delete(ctx context.Context, key datastore.Key) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := cds.inner.Delete(ctx, key); err != nil {
+		return err
+	}
+	cds.invalidate(key.String())
+	return nil
+}
+
+func (cds *CachedDatastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	return cds.inner.Query(ctx, q)
+}
+
+func (cds *CachedDatastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	return cds.inner.Sync(ctx, prefix)
+}
+
+func (cds *CachedDatastore) Close() error {
+	return cds.inner.Close()
+}
+
+// Batch passes through to the inner Datastore's own Batch if it supports
+// one. Keys written or deleted through the returned Batch bypass the cache
+// entirely, so stale entries for those keys live until they expire, are
+// evicted, or are invalidated by a direct Put/Delete.
+func (cds *CachedDatastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	batching, ok := cds.inner.(datastore.Batching)
+	if !ok {
+		return nil, datastore.ErrBatchUnsupported
+	}
+	return batching.Batch(ctx)
+}
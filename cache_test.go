@@ -0,0 +1,355 @@
+package rados
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	datastore "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// countingDatastore is a trivial in-memory datastore.Datastore that counts
+// calls, so tests can assert on how many times CachedDatastore actually
+// reaches through to it.
+type countingDatastore struct {
+	mu   sync.Mutex
+	data map[string][]byte
+
+	gets    atomic.Int32
+	puts    atomic.Int32
+	deletes atomic.Int32
+	hases   atomic.Int32
+
+	// getDelay, when set, is slept in every Get after the value has been
+	// read, to widen the window for concurrent callers to coalesce onto the
+	// same call.
+	getDelay time.Duration
+}
+
+func newCountingDatastore() *countingDatastore {
+	return &countingDatastore{data: make(map[string][]byte)}
+}
+
+func (c *countingDatastore) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	c.gets.Add(1)
+	c.mu.Lock()
+	v, ok := c.data[key.String()]
+	c.mu.Unlock()
+	// getDelay simulates RADOS read latency after the value has already
+	// been fetched, so a racing Put/Delete that lands during the delay
+	// can invalidate a result that's already "in flight" back to the
+	// caller.
+	if c.getDelay > 0 {
+		time.Sleep(c.getDelay)
+	}
+	if !ok {
+		return nil, datastore.ErrNotFound
+	}
+	return v, nil
+}
+
+func (c *countingDatastore) Has(ctx context.Context, key datastore.Key) (bool, error) {
+	c.hases.Add(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.data[key.String()]
+	return ok, nil
+}
+
+func (c *countingDatastore) GetSize(ctx context.Context, key datastore.Key) (int, error) {
+	v, err := c.Get(ctx, key)
+	if err != nil {
+		return -1, err
+	}
+	return len(v), nil
+}
+
+func (c *countingDatastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	return dsq.ResultsWithEntries(q, nil), nil
+}
+
+func (c *countingDatastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	c.puts.Add(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.data[key.String()] = value
+	return nil
+}
+
+func (c *countingDatastore) Delete(ctx context.Context, key datastore.Key) error {
+	c.deletes.Add(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.data, key.String())
+	return nil
+}
+
+func (c *countingDatastore) Sync(ctx context.Context, prefix datastore.Key) error { return nil }
+func (c *countingDatastore) Close() error                                         { return nil }
+
+func TestCachedDatastoreGetServesFromCache(t *testing.T) {
+	ctx := context.Background()
+	inner := newCountingDatastore()
+	cds, err := NewCachedDatastore(inner, CacheOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, val := datastore.NewKey("/foo"), []byte("bar")
+	if err := cds.Put(ctx, key, val); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		got, err := cds.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, val) {
+			t.Fatalf("got %q, want %q", got, val)
+		}
+	}
+	// The first Get after Put is a miss (Put invalidates); the rest should
+	// all be served from cache.
+	if n := inner.gets.Load(); n != 1 {
+		t.Errorf("inner.Get called %d times, want 1", n)
+	}
+}
+
+// TestCachedDatastoreCoalescesGets mirrors the coalesce_test pattern: many
+// concurrent Gets for the same key should collapse into a single inner
+// call, not one per caller.
+func TestCachedDatastoreCoalescesGets(t *testing.T) {
+	ctx := context.Background()
+	inner := newCountingDatastore()
+	inner.getDelay = 20 * time.Millisecond
+	cds, err := NewCachedDatastore(inner, CacheOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, val := datastore.NewKey("/coalesced"), []byte("v")
+	inner.data[key.String()] = val
+
+	const concurrency = 50
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := cds.Get(ctx, key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, val) {
+				t.Errorf("got %q, want %q", got, val)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := inner.gets.Load(); n != 1 {
+		t.Errorf("inner.Get called %d times across %d concurrent callers, want 1", n, concurrency)
+	}
+}
+
+func TestCachedDatastoreInvalidatesOnPutAndDelete(t *testing.T) {
+	ctx := context.Background()
+	inner := newCountingDatastore()
+	cds, err := NewCachedDatastore(inner, CacheOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := datastore.NewKey("/foo")
+
+	if err := cds.Put(ctx, key, []byte("v1")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := cds.Get(ctx, key); err != nil || !bytes.Equal(got, []byte("v1")) {
+		t.Fatalf("Get() = %q, %v, want v1, nil", got, err)
+	}
+
+	if err := cds.Put(ctx, key, []byte("v2")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := cds.Get(ctx, key)
+	if err != nil || !bytes.Equal(got, []byte("v2")) {
+		t.Fatalf("Get() after overwrite = %q, %v, want v2, nil", got, err)
+	}
+	if n := inner.gets.Load(); n != 2 {
+		t.Errorf("inner.Get called %d times, want 2 (one per distinct value)", n)
+	}
+
+	if err := cds.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cds.Get(ctx, key); !errors.Is(err, datastore.ErrNotFound) {
+		t.Fatalf("Get() after Delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestCachedDatastoreHasTracksCacheIndependently(t *testing.T) {
+	ctx := context.Background()
+	inner := newCountingDatastore()
+	cds, err := NewCachedDatastore(inner, CacheOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, val := datastore.NewKey("/foo"), []byte("v")
+	if err := cds.Put(ctx, key, val); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		exists, err := cds.Has(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !exists {
+			t.Fatal("expected key to exist")
+		}
+	}
+	if n := inner.hases.Load(); n != 1 {
+		t.Errorf("inner.Has called %d times, want 1", n)
+	}
+
+	if err := cds.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	exists, err := cds.Has(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("expected key to be gone after Delete")
+	}
+}
+
+func TestCachedDatastoreNegativeCaching(t *testing.T) {
+	ctx := context.Background()
+	inner := newCountingDatastore()
+	cds, err := NewCachedDatastore(inner, CacheOptions{NegativeTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := datastore.NewKey("/missing")
+
+	for i := 0; i < 3; i++ {
+		if _, err := cds.Get(ctx, key); !errors.Is(err, datastore.ErrNotFound) {
+			t.Fatalf("Get() = %v, want ErrNotFound", err)
+		}
+	}
+	if n := inner.gets.Load(); n != 1 {
+		t.Errorf("inner.Get called %d times, want 1 (negative result should be cached)", n)
+	}
+}
+
+func TestCachedDatastoreTTLExpires(t *testing.T) {
+	ctx := context.Background()
+	inner := newCountingDatastore()
+	cds, err := NewCachedDatastore(inner, CacheOptions{TTL: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, val := datastore.NewKey("/foo"), []byte("v")
+	inner.data[key.String()] = val
+
+	if _, err := cds.Get(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := cds.Get(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if n := inner.gets.Load(); n != 2 {
+		t.Errorf("inner.Get called %d times, want 2 (cache entry should have expired)", n)
+	}
+}
+
+// TestCachedDatastoreGetDoesNotCacheStaleValueRacingPut interleaves a slow
+// Get against a concurrent Put for the same key: the Get's inner fetch
+// starts before the Put, but (thanks to getDelay) only finishes reading
+// its now-stale value after the Put has already invalidated the key. The
+// cache must not let that stale read land after the invalidation.
+func TestCachedDatastoreGetDoesNotCacheStaleValueRacingPut(t *testing.T) {
+	ctx := context.Background()
+	inner := newCountingDatastore()
+	inner.getDelay = 20 * time.Millisecond
+	cds, err := NewCachedDatastore(inner, CacheOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := datastore.NewKey("/racy")
+	inner.data[key.String()] = []byte("v1")
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// Starts reading "v1" immediately, but won't return it to the
+		// cache until after getDelay, by which point Put below has
+		// already run.
+		cds.Get(ctx, key)
+	}()
+	go func() {
+		defer wg.Done()
+		time.Sleep(5 * time.Millisecond)
+		if err := cds.Put(ctx, key, []byte("v2")); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+
+	got, err := cds.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("v2")) {
+		t.Fatalf("Get() after racing Put = %q, want v2 (stale v1 leaked into the cache)", got)
+	}
+}
+
+// TestCachedDatastoreGenStaysBounded simulates a write-heavy workload
+// (Put then Delete across many distinct keys, none ever read back) to
+// check that the generation tracker doesn't grow without bound alongside
+// it, the way it would if invalidate simply grew a plain map forever.
+func TestCachedDatastoreGenStaysBounded(t *testing.T) {
+	ctx := context.Background()
+	inner := newCountingDatastore()
+	const size = 16
+	cds, err := NewCachedDatastore(inner, CacheOptions{Size: size})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < size*10; i++ {
+		key := datastore.NewKey(fmt.Sprintf("/gen/%d", i))
+		if err := cds.Put(ctx, key, []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := cds.Delete(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := cds.gen.Len(); n > size {
+		t.Errorf("gen.Len() = %d, want <= %d (bounded by CacheOptions.Size)", n, size)
+	}
+}
+
+func TestCachedDatastoreBatchUnsupportedWithoutBatching(t *testing.T) {
+	ctx := context.Background()
+	inner := newCountingDatastore()
+	cds, err := NewCachedDatastore(inner, CacheOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cds.Batch(ctx); !errors.Is(err, datastore.ErrBatchUnsupported) {
+		t.Fatalf("Batch() error = %v, want ErrBatchUnsupported", err)
+	}
+}
@@ -0,0 +1,74 @@
+package rados
+
+import (
+	"sync"
+
+	"github.com/ceph/go-ceph/rados"
+)
+
+// defaultMaxIdleIOContexts bounds how many IOContexts an ioctxPool keeps
+// warm for reuse. Contexts returned beyond this count are destroyed rather
+// than retained, so a burst of concurrency doesn't pin an unbounded number
+// of open contexts against the cluster.
+const defaultMaxIdleIOContexts = 64
+
+// ioctxPool hands out *rados.IOContext instances for the lifetime of a
+// single operation and takes them back afterwards, reusing idle ones
+// instead of paying an OpenIOContext/Destroy round trip on every call. It
+// replaces the single mutex the Datastore used to serialize all RADOS I/O
+// through, letting independent goroutines issue OSD ops concurrently.
+type ioctxPool struct {
+	conn    *rados.Conn
+	pool    string
+	maxIdle int
+
+	mu   sync.Mutex
+	idle []*rados.IOContext
+}
+
+func newIOCtxPool(conn *rados.Conn, pool string, maxIdle int) *ioctxPool {
+	if maxIdle <= 0 {
+		maxIdle = defaultMaxIdleIOContexts
+	}
+	return &ioctxPool{conn: conn, pool: pool, maxIdle: maxIdle}
+}
+
+// Get returns an idle IOContext if one is available, otherwise opens a new
+// one. The namespace of a reused IOContext is whatever the last borrower
+// left it as, so callers must always SetNamespace before use.
+func (p *ioctxPool) Get() (*rados.IOContext, error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		ioctx := p.idle[n-1]
+		p.idle[n-1] = nil
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return ioctx, nil
+	}
+	p.mu.Unlock()
+	return p.conn.OpenIOContext(p.pool)
+}
+
+// Put returns an IOContext to the pool for reuse, or destroys it if the
+// pool already has maxIdle idle contexts.
+func (p *ioctxPool) Put(ioctx *rados.IOContext) {
+	p.mu.Lock()
+	if len(p.idle) >= p.maxIdle {
+		p.mu.Unlock()
+		ioctx.Destroy()
+		return
+	}
+	p.idle = append(p.idle, ioctx)
+	p.mu.Unlock()
+}
+
+// Close destroys every idle IOContext held by the pool.
+func (p *ioctxPool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	for _, ioctx := range idle {
+		ioctx.Destroy()
+	}
+}
@@ -0,0 +1,222 @@
+package rados
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/ceph/go-ceph/rados"
+	datastore "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// indexObject is the well-known per-namespace RADOS object whose omap
+// mirrors every key written to that namespace, so that Query can seek
+// through keys in sorted order instead of listing and filtering every
+// object in the pool.
+const indexObject = "INDEX"
+
+// indexBuiltObject marks that indexObject already reflects every object in
+// the default namespace. Pools written to before this index existed, or by
+// another client that bypasses this package, start without it; Put and
+// Delete alone would only ever cover keys written after that point, so
+// queryIndexed would silently serve an incomplete result for everything
+// already in the pool. ensureIndexBuilt backfills indexObject from a single
+// full scan the first time this Datastore instance needs it, and writes
+// this marker so later calls don't repeat the scan.
+const indexBuiltObject = "INDEX_BUILT"
+
+// indexPageSize bounds how many omap entries are pulled from the index
+// object per RADOS round trip while paging through an indexed query, and
+// how many entries ensureIndexBuilt batches per SetOmap call.
+const indexPageSize = 1000
+
+// indexableQuery reports whether q can be served by the sorted-key omap
+// index instead of a full pool scan: no value/arbitrary Filters, and
+// either no requested order (the index's natural order is as good as any)
+// or a plain ascending key order, which the index already provides.
+func indexableQuery(q dsq.Query) bool {
+	if len(q.Filters) != 0 {
+		return false
+	}
+	switch len(q.Orders) {
+	case 0:
+		return true
+	case 1:
+		_, ok := q.Orders[0].(dsq.OrderByKey)
+		return ok
+	default:
+		return false
+	}
+}
+
+// ensureIndexBuilt backfills indexObject from a full scan of the default
+// namespace, unless indexBuiltObject already shows a previous backfill
+// (by this Datastore or another client sharing the pool) completed. It is
+// safe to call concurrently: the check-then-build section is serialized by
+// ds.indexBuildMu, and ds.indexReady short-circuits every call once built.
+func (ds *Datastore) ensureIndexBuilt(ctx context.Context) error {
+	if ds.indexReady.Load() {
+		return nil
+	}
+	ds.indexBuildMu.Lock()
+	defer ds.indexBuildMu.Unlock()
+	if ds.indexReady.Load() {
+		return nil
+	}
+
+	ioctx, err := ds.ioctxs.Get()
+	if err != nil {
+		return err
+	}
+	defer ds.ioctxs.Put(ioctx)
+	ioctx.SetNamespace("")
+
+	if _, err := ioctx.Stat(indexBuiltObject); err == nil {
+		ds.indexReady.Store(true)
+		return nil
+	} else if err != rados.RadosErrorNotFound {
+		return err
+	}
+
+	iter, err := ioctx.Iter()
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	batch := make(map[string][]byte, indexPageSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := ioctx.SetOmap(indexObject, batch); err != nil {
+			return err
+		}
+		for k := range batch {
+			delete(batch, k)
+		}
+		return nil
+	}
+	for iter.Next() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := iter.Value()
+		if name == shardObject || name == indexObject || name == indexBuiltObject {
+			continue
+		}
+		batch[name] = []byte{}
+		if len(batch) >= indexPageSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	if err := ioctx.WriteFull(indexBuiltObject, []byte("1")); err != nil {
+		return err
+	}
+	ds.indexReady.Store(true)
+	return nil
+}
+
+// queryIndexed serves q directly from the sorted-key omap index, seeking
+// past q.Offset entries and stopping after q.Limit without ever
+// materializing the full key space. The returned bool reports whether the
+// index could serve the query at all; when false, the caller should fall
+// back to the naive full-pool scan. Sharded datastores always fall back,
+// since merging several per-namespace indexes in sorted order isn't
+// implemented yet. An unsharded datastore also falls back, for this call
+// only, if the one-time index backfill fails (e.g. the context is
+// canceled mid-scan); the next call tries the backfill again.
+func (ds *Datastore) queryIndexed(ctx context.Context, q dsq.Query) (dsq.Results, bool, error) {
+	if ds.shard != nil || !indexableQuery(q) {
+		return nil, false, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, true, err
+	}
+	if err := ds.ensureIndexBuilt(ctx); err != nil {
+		return nil, false, nil
+	}
+
+	listCtx, err := ds.ioctxs.Get()
+	if err != nil {
+		return nil, true, err
+	}
+	listCtx.SetNamespace("")
+
+	reschan := make(chan dsq.Result, dsq.KeysOnlyBufSize)
+	go func() {
+		defer close(reschan)
+		defer ds.ioctxs.Put(listCtx)
+
+		var valueCtx *rados.IOContext
+		if !q.KeysOnly {
+			var err error
+			valueCtx, err = ds.ioctxs.Get()
+			if err != nil {
+				reschan <- dsq.Result{Error: err}
+				return
+			}
+			defer ds.ioctxs.Put(valueCtx)
+			valueCtx.SetNamespace("")
+		}
+
+		startAfter := ""
+		skipped := 0
+		emitted := 0
+		for {
+			if err := ctx.Err(); err != nil {
+				reschan <- dsq.Result{Error: err}
+				return
+			}
+			page, err := listCtx.GetOmapValues(indexObject, startAfter, q.Prefix, indexPageSize)
+			if err != nil && err != rados.RadosErrorNotFound {
+				reschan <- dsq.Result{Error: err}
+				return
+			}
+			if len(page) == 0 {
+				return
+			}
+			keys := make([]string, 0, len(page))
+			for k := range page {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			for _, k := range keys {
+				startAfter = k
+				if skipped < q.Offset {
+					skipped++
+					continue
+				}
+				if q.Limit > 0 && emitted >= q.Limit {
+					return
+				}
+				if q.KeysOnly {
+					reschan <- dsq.Result{Entry: dsq.Entry{Key: k}}
+				} else {
+					v, err := readValue(ctx, valueCtx, datastore.NewKey(k))
+					if err != nil {
+						reschan <- dsq.Result{Error: fmt.Errorf("failed to fetch value for key %q: %w", k, err)}
+						return
+					}
+					reschan <- dsq.Result{Entry: dsq.Entry{Key: k, Value: v}}
+				}
+				emitted++
+			}
+			if len(keys) < indexPageSize {
+				return
+			}
+		}
+	}()
+
+	return dsq.ResultsWithChan(q, reschan), true, nil
+}
@@ -0,0 +1,159 @@
+package rados
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/ceph/go-ceph/rados"
+	datastore "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func TestIndexableQuery(t *testing.T) {
+	cases := []struct {
+		name string
+		q    dsq.Query
+		want bool
+	}{
+		{"no filters or orders", dsq.Query{}, true},
+		{"order by key", dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}}}, true},
+		{"has a filter", dsq.Query{Filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/a"}}}, false},
+		{"order by value", dsq.Query{Orders: []dsq.Order{dsq.OrderByValue{}}}, false},
+		{"two orders", dsq.Query{Orders: []dsq.Order{dsq.OrderByKey{}, dsq.OrderByKeyDescending{}}}, false},
+	}
+	for _, c := range cases {
+		if got := indexableQuery(c.q); got != c.want {
+			t.Errorf("%s: indexableQuery() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// TestQueryIndexedMatchesNaive checks that the indexed path and the naive
+// full-scan fallback agree on results, for both a query the index can serve
+// and one (with a filter) that forces the naive path.
+func TestQueryIndexedMatchesNaive(t *testing.T) {
+	ctx := context.Background()
+	ds, err := newOrAbort(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestCases(t, ds, testcases)
+	defer removeTestCases(t, ds, testcases)
+
+	rs, err := ds.Query(ctx, dsq.Query{Prefix: "/a/", Orders: []dsq.Order{dsq.OrderByKey{}}, KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{
+		"/a/b",
+		"/a/b/c",
+		"/a/b/d",
+		"/a/c",
+		"/a/d",
+	}, rs)
+
+	rs, err = ds.Query(ctx, dsq.Query{Prefix: "/a/", Filters: []dsq.Filter{dsq.FilterKeyPrefix{Prefix: "/a/"}}, KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{
+		"/a/b",
+		"/a/b/c",
+		"/a/b/d",
+		"/a/c",
+		"/a/d",
+	}, rs)
+}
+
+// TestQueryIndexedBackfillsPreexistingObjects simulates the realistic
+// upgrade path: objects already in the pool before this index existed (or
+// written by another client that bypasses Put entirely), so INDEX has no
+// entry for them yet. Query must still find them, by backfilling INDEX
+// from a full scan rather than trusting an index that predates the data.
+func TestQueryIndexedBackfillsPreexistingObjects(t *testing.T) {
+	ctx := context.Background()
+	ds, err := newOrAbort(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.NewKey("/unindexed")
+	ioctx, err := ds.ioctxs.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioctx.SetNamespace(ds.namespace(key.String()[1:]))
+	// Drop any backfill marker an earlier test left in the pool, so this
+	// Datastore sees the pool as one whose index was never built.
+	if err := ioctx.Delete(indexBuiltObject); err != nil && err != rados.RadosErrorNotFound {
+		ds.ioctxs.Put(ioctx)
+		t.Fatal(err)
+	}
+	if err := ioctx.WriteFull(key.String(), []byte("preexisting")); err != nil {
+		ds.ioctxs.Put(ioctx)
+		t.Fatal(err)
+	}
+	ds.ioctxs.Put(ioctx)
+	defer ds.Delete(ctx, key)
+
+	rs, err := ds.Query(ctx, dsq.Query{Prefix: "/unindexed", KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/unindexed"}, rs)
+}
+
+// BenchmarkQuery compares the naive full-scan path against the indexed path
+// at 1e5 and 1e6 keys, to demonstrate the indexed path stays fast as the
+// pool grows instead of degrading linearly with total object count.
+func BenchmarkQuery(b *testing.B) {
+	for _, n := range []int{100_000, 1_000_000} {
+		b.Run(fmt.Sprintf("scan/%d", n), func(b *testing.B) {
+			benchmarkQuery(b, n, true)
+		})
+		b.Run(fmt.Sprintf("indexed/%d", n), func(b *testing.B) {
+			benchmarkQuery(b, n, false)
+		})
+	}
+}
+
+func benchmarkQuery(b *testing.B, n int, forceScan bool) {
+	ctx := context.Background()
+	ds, err := newOrAbort(b)
+	if err != nil {
+		b.Fatal(err)
+	}
+	prefix := "/bench/" + strconv.Itoa(n) + "/"
+	for i := 0; i < n; i++ {
+		key := datastore.NewKey(prefix + strconv.Itoa(i))
+		if err := ds.Put(ctx, key, []byte("v")); err != nil {
+			b.Fatal(err)
+		}
+	}
+	defer func() {
+		for i := 0; i < n; i++ {
+			ds.Delete(ctx, datastore.NewKey(prefix+strconv.Itoa(i)))
+		}
+	}()
+
+	q := dsq.Query{Prefix: prefix, KeysOnly: true, Limit: 10}
+	if forceScan {
+		// No filter, not even this redundant key-prefix one, is servable by
+		// the index, so this exercises
+		// the naive ioctx.Iter() path even though an index exists.
+		q.Filters = []dsq.Filter{dsq.FilterKeyPrefix{Prefix: prefix}}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rs, err := ds.Query(ctx, q)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := rs.Rest(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
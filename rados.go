@@ -2,6 +2,7 @@ package rados
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/ceph/go-ceph/rados"
@@ -10,13 +11,23 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
+var _ datastore.Datastore = (*Datastore)(nil)
+var _ datastore.Batching = (*Datastore)(nil)
+
 type Datastore struct {
-	mu       sync.Mutex
 	conn     *rados.Conn
+	ioctxs   *ioctxPool
 	confPath string
 	pool     string
+	shard    *ShardIdV1
+
+	// indexReady and indexBuildMu guard the one-time omap index backfill
+	// in query_index.go.
+	indexReady   atomic.Bool
+	indexBuildMu sync.Mutex
 }
 
 func NewDatastore(confPath string, pool string) (*Datastore, error) {
@@ -36,38 +47,116 @@ func NewDatastore(confPath string, pool string) (*Datastore, error) {
 		fmt.Fprintf(os.Stderr, "Failed to connect to rados\n")
 		return nil, err
 	}
+	ds.ioctxs = newIOCtxPool(ds.conn, ds.pool, defaultMaxIdleIOContexts)
 	return ds, nil
 }
 
-func (ds *Datastore) Shutdown() {
-	ds.conn.Shutdown()
+// NewShardedDatastore opens a Datastore that routes keys to RADOS
+// namespaces according to shard. The first time a pool is opened with a
+// given shard, the shard's config is persisted to a well-known SHARDING
+// object; later opens (even from other processes) must use the same
+// ShardFunc, exactly as go-ds-flatfs refuses to open a repo whose on-disk
+// SHARDING file doesn't match.
+func NewShardedDatastore(confPath string, pool string, shard *ShardIdV1) (*Datastore, error) {
+	ds, err := NewDatastore(confPath, pool)
+	if err != nil {
+		return nil, err
+	}
+	if err := ds.checkOrWriteShardConfig(shard); err != nil {
+		ds.Shutdown()
+		return nil, err
+	}
+	ds.shard = shard
+	return ds, nil
 }
 
-func (ds *Datastore) Put(key datastore.Key, value []byte) error {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
-	ioctx, err := ds.conn.OpenIOContext(ds.pool)
+func (ds *Datastore) checkOrWriteShardConfig(shard *ShardIdV1) error {
+	ioctx, err := ds.ioctxs.Get()
 	if err != nil {
 		return err
 	}
-	defer ioctx.Destroy()
-	err = ioctx.Write(key.String(), value, 0)
-	return err
+	defer ds.ioctxs.Put(ioctx)
+	ioctx.SetNamespace("")
+
+	stored, err := readShardObject(ioctx)
+	if err == datastore.ErrNotFound {
+		return ioctx.WriteFull(shardObject, []byte(shard.String()))
+	}
+	if err != nil {
+		return err
+	}
+	existing, err := ParseShardFunc(stored)
+	if err != nil {
+		return fmt.Errorf("pool %q has an unreadable %s object: %w", ds.pool, shardObject, err)
+	}
+	if existing.String() != shard.String() {
+		return fmt.Errorf("pool %q was sharded with %q, refusing to open with %q", ds.pool, existing.String(), shard.String())
+	}
+	return nil
 }
 
-func (ds *Datastore) Get(key datastore.Key) (value []byte, err error) {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
-	var ioctx *rados.IOContext
-	ioctx, err = ds.conn.OpenIOContext(ds.pool)
+func readShardObject(ioctx *rados.IOContext) (string, error) {
+	var result bytes.Buffer
+	buf := make([]byte, 1024)
+	var offset uint64
+	for {
+		count, err := ioctx.Read(shardObject, buf, offset)
+		if err != nil {
+			if err == rados.RadosErrorNotFound {
+				return "", datastore.ErrNotFound
+			}
+			return "", err
+		}
+		if count < len(buf) {
+			result.Write(buf[:count])
+			break
+		}
+		offset += uint64(count)
+		result.Write(buf)
+	}
+	return result.String(), nil
+}
+
+func (ds *Datastore) Shutdown() {
+	ds.ioctxs.Close()
+	ds.conn.Shutdown()
+}
+
+func (ds *Datastore) Put(ctx context.Context, key datastore.Key, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ioctx, err := ds.ioctxs.Get()
 	if err != nil {
-		return
+		return err
 	}
-	defer ioctx.Destroy()
+	defer ds.ioctxs.Put(ioctx)
+	ioctx.SetNamespace(ds.namespace(key.String()[1:]))
+	if err := ioctx.Write(key.String(), value, 0); err != nil {
+		return err
+	}
+	if ds.shard != nil {
+		// queryIndexed never builds or consults an index for a sharded
+		// Datastore (merging several per-namespace indexes isn't
+		// implemented yet), so maintaining one here would just be a wasted
+		// round trip on every Put.
+		return nil
+	}
+	return ioctx.SetOmap(indexObject, map[string][]byte{key.String(): {}})
+}
+
+// readValue runs the chunked read loop against an already-borrowed,
+// already-namespaced IOContext. It is split out of Get so that Query can
+// fetch values through its own IOContext instead of recursing back into
+// Get (and thus borrowing a second one from the pool per result).
+func readValue(ctx context.Context, ioctx *rados.IOContext, key datastore.Key) (value []byte, err error) {
 	var result bytes.Buffer
 	var buf []byte = make([]byte, 1024)
 	var offset uint64
 	for {
+		if err = ctx.Err(); err != nil {
+			return
+		}
 		var count int
 		count, err = ioctx.Read(key.String(), buf, offset)
 		if err != nil {
@@ -88,50 +177,114 @@ func (ds *Datastore) Get(key datastore.Key) (value []byte, err error) {
 	return
 }
 
-func (ds *Datastore) Delete(key datastore.Key) error {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
-	ioctx, err := ds.conn.OpenIOContext(ds.pool)
+func (ds *Datastore) Get(ctx context.Context, key datastore.Key) (value []byte, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	var ioctx *rados.IOContext
+	ioctx, err = ds.ioctxs.Get()
+	if err != nil {
+		return
+	}
+	defer ds.ioctxs.Put(ioctx)
+	ioctx.SetNamespace(ds.namespace(key.String()[1:]))
+	return readValue(ctx, ioctx, key)
+}
+
+func (ds *Datastore) Delete(ctx context.Context, key datastore.Key) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ioctx, err := ds.ioctxs.Get()
 	if err != nil {
 		return err
 	}
-	defer ioctx.Destroy()
-	err = ioctx.Delete(key.String())
-	return err
+	defer ds.ioctxs.Put(ioctx)
+	ioctx.SetNamespace(ds.namespace(key.String()[1:]))
+	if err := ioctx.Delete(key.String()); err != nil {
+		return err
+	}
+	if ds.shard != nil {
+		// See the matching check in Put: a sharded Datastore never builds
+		// or consults this index.
+		return nil
+	}
+	if err := ioctx.RmOmapKeys(indexObject, []string{key.String()}); err != nil && err != rados.RadosErrorNotFound {
+		return err
+	}
+	return nil
 }
 
-func (ds *Datastore) Query(q dsq.Query) (dsq.Results, error) {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
-	ioctx, err := ds.conn.OpenIOContext(ds.pool)
+func (ds *Datastore) Query(ctx context.Context, q dsq.Query) (dsq.Results, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Prefer seeking through the sorted-key omap index over a full pool
+	// scan whenever the query can be served by it.
+	if qr, ok, err := ds.queryIndexed(ctx, q); ok {
+		return qr, err
+	}
+
+	listCtx, err := ds.ioctxs.Get()
 	if err != nil {
 		return nil, err
 	}
+	if ds.shard != nil {
+		// Fan out across every namespace the shard func may have placed
+		// keys under, rather than just the default namespace.
+		listCtx.SetNamespace(rados.AllNamespaces)
+	} else {
+		listCtx.SetNamespace("")
+	}
 
 	reschan := make(chan dsq.Result, dsq.KeysOnlyBufSize)
 	go func() {
 		defer close(reschan)
-		defer ioctx.Destroy()
-		iter, err := ioctx.Iter()
-		defer iter.Close()
+		defer ds.ioctxs.Put(listCtx)
+		iter, err := listCtx.Iter()
 		if err != nil {
 			reschan <- dsq.Result{Error: errors.New("Failed to fetch rados iterator")}
 			return
 		}
+		defer iter.Close()
+
+		// A second, dedicated IOContext for fetching values so the
+		// iteration above is never blocked behind (or blocking) a
+		// recursive Get call.
+		var valueCtx *rados.IOContext
+		if !q.KeysOnly {
+			valueCtx, err = ds.ioctxs.Get()
+			if err != nil {
+				reschan <- dsq.Result{Error: err}
+				return
+			}
+			defer ds.ioctxs.Put(valueCtx)
+		}
+
 		for iter.Next() {
+			if err := ctx.Err(); err != nil {
+				reschan <- dsq.Result{Error: err}
+				return
+			}
+			if iter.Value() == shardObject || iter.Value() == indexObject {
+				continue
+			}
 			if q.Prefix != "" && !strings.HasPrefix(iter.Value(), q.Prefix) {
 				continue
 			}
 			if q.KeysOnly {
 				reschan <- dsq.Result{Entry: dsq.Entry{Key: iter.Value()}}
-			} else {
-				v, err := ds.Get(datastore.NewKey(iter.Value()))
-				if err != nil {
-					fmt.Errorf("Failed to fetch value for key '%s'", iter.Value())
-					return
-				}
-				reschan <- dsq.Result{Entry: dsq.Entry{Key: iter.Value(), Value: v}}
+				continue
+			}
+			key := datastore.NewKey(iter.Value())
+			valueCtx.SetNamespace(ds.namespace(key.String()[1:]))
+			v, err := readValue(ctx, valueCtx, key)
+			if err != nil {
+				reschan <- dsq.Result{Error: fmt.Errorf("failed to fetch value for key %q: %w", iter.Value(), err)}
+				return
 			}
+			reschan <- dsq.Result{Entry: dsq.Entry{Key: iter.Value(), Value: v}}
 		}
 	}()
 	qr := dsq.ResultsWithChan(q, reschan)
@@ -149,14 +302,16 @@ func (ds *Datastore) Query(q dsq.Query) (dsq.Results, error) {
 	return qr, nil
 }
 
-func (ds *Datastore) Has(key datastore.Key) (exists bool, err error) {
-	ds.mu.Lock()
-	defer ds.mu.Unlock()
-	ioctx, err := ds.conn.OpenIOContext(ds.pool)
+func (ds *Datastore) Has(ctx context.Context, key datastore.Key) (exists bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	ioctx, err := ds.ioctxs.Get()
 	if err != nil {
 		return
 	}
-	defer ioctx.Destroy()
+	defer ds.ioctxs.Put(ioctx)
+	ioctx.SetNamespace(ds.namespace(key.String()[1:]))
 	_, err = ioctx.Stat(key.String())
 	if err != nil {
 		if err == rados.RadosErrorNotFound {
@@ -170,8 +325,42 @@ func (ds *Datastore) Has(key datastore.Key) (exists bool, err error) {
 	return
 }
 
-func (ds *Datastore) Batch() (datastore.Batch, error) {
-	return datastore.NewBasicBatch(ds), nil
+func (ds *Datastore) GetSize(ctx context.Context, key datastore.Key) (size int, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	ioctx, err := ds.ioctxs.Get()
+	if err != nil {
+		return
+	}
+	defer ds.ioctxs.Put(ioctx)
+	ioctx.SetNamespace(ds.namespace(key.String()[1:]))
+	var stat rados.ObjectStat
+	stat, err = ioctx.Stat(key.String())
+	if err != nil {
+		if err == rados.RadosErrorNotFound {
+			err = datastore.ErrNotFound
+		}
+		return
+	}
+	size = int(stat.Size)
+	return
+}
+
+// Sync guarantees that any Put or Delete calls under prefix that returned
+// before Sync(prefix) was called will be observed after Sync(prefix)
+// returns. RADOS Write/Delete ops already return only once they're durable
+// on the OSDs, so there is nothing to flush here beyond honoring context
+// cancellation.
+func (ds *Datastore) Sync(ctx context.Context, prefix datastore.Key) error {
+	return ctx.Err()
+}
+
+func (ds *Datastore) Batch(ctx context.Context) (datastore.Batch, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return newBatch(ds)
 }
 
 func (ds *Datastore) Close() error {
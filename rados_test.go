@@ -2,41 +2,47 @@ package rados
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	datastore "github.com/ipfs/go-datastore"
 	dsq "github.com/ipfs/go-datastore/query"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestPutGetBytes(t *testing.T) {
+	ctx := context.Background()
 	ds, err := newOrAbort(t)
 	if err != nil {
 		t.Fatal(err)
 	}
 	key, val := datastore.NewKey("/foo"), []byte("bar")
-	err = ds.Put(key, val)
+	err = ds.Put(ctx, key, val)
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = ds.Get(key)
+	_, err = ds.Get(ctx, key)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestBasicQuery(t *testing.T) {
+	ctx := context.Background()
 	ds, err := newOrAbort(t)
 	if err != nil {
 		t.Fatal(err)
 	}
 	key, val := datastore.NewKey("/basic"), []byte("basicvalue")
-	err = ds.Put(key, val)
+	err = ds.Put(ctx, key, val)
 	if err != nil {
 		t.Fatal(err)
 	}
 	q := dsq.Query{Prefix: "/basic"}
-	qr, err := ds.Query(q)
+	qr, err := ds.Query(ctx, q)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -54,7 +60,7 @@ func TestBasicQuery(t *testing.T) {
 	if !found {
 		t.Fatal(fmt.Errorf("Failed to query"))
 	}
-	err = ds.Delete(key)
+	err = ds.Delete(ctx, key)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -72,13 +78,14 @@ var testcases = map[string]string{
 }
 
 func TestQuery(t *testing.T) {
+	ctx := context.Background()
 	ds, err := newOrAbort(t)
 	if err != nil {
 		t.Fatal(err)
 	}
 	addTestCases(t, ds, testcases)
 
-	rs, err := ds.Query(dsq.Query{Prefix: "/a/", KeysOnly: true})
+	rs, err := ds.Query(ctx, dsq.Query{Prefix: "/a/", KeysOnly: true})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -93,7 +100,7 @@ func TestQuery(t *testing.T) {
 
 	// test offset and limit
 
-	rs, err = ds.Query(dsq.Query{
+	rs, err = ds.Query(ctx, dsq.Query{
 		Prefix:   "/a/",
 		Offset:   2,
 		Limit:    2,
@@ -111,16 +118,17 @@ func TestQuery(t *testing.T) {
 }
 
 func addTestCases(t *testing.T, ds *Datastore, testcases map[string]string) {
+	ctx := context.Background()
 	for k, v := range testcases {
 		dsk := datastore.NewKey(k)
-		if err := ds.Put(dsk, []byte(v)); err != nil {
+		if err := ds.Put(ctx, dsk, []byte(v)); err != nil {
 			t.Fatal(err)
 		}
 	}
 
 	for k, v := range testcases {
 		dsk := datastore.NewKey(k)
-		v2, err := ds.Get(dsk)
+		v2, err := ds.Get(ctx, dsk)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -131,9 +139,10 @@ func addTestCases(t *testing.T, ds *Datastore, testcases map[string]string) {
 }
 
 func removeTestCases(t *testing.T, ds *Datastore, testcases map[string]string) {
+	ctx := context.Background()
 	for k, _ := range testcases {
 		dsk := datastore.NewKey(k)
-		if err := ds.Delete(dsk); err != nil {
+		if err := ds.Delete(ctx, dsk); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -161,71 +170,195 @@ func expectMatches(t *testing.T, expect []string, actualR dsq.Results) {
 	}
 }
 
+// TestConcurrentPutGetQuery hammers a single Datastore from many goroutines
+// at once. Before the IOContext pool replaced the top-level mutex, Query's
+// non-KeysOnly path recursed into the locked Get and deadlocked the moment
+// it ran concurrently with any other op; this proves that's gone, and gives
+// a rough sense of the throughput win from letting ops run in parallel.
+func TestConcurrentPutGetQuery(t *testing.T) {
+	ctx := context.Background()
+	ds, err := newOrAbort(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 16
+	const keysPerWorker = 20
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < keysPerWorker; i++ {
+				key := datastore.NewKey("/concurrent/" + strconv.Itoa(w) + "/" + strconv.Itoa(i))
+				val := []byte(key.String())
+				if err := ds.Put(ctx, key, val); err != nil {
+					t.Error(err)
+					return
+				}
+				got, err := ds.Get(ctx, key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if !bytes.Equal(got, val) {
+					t.Errorf("%s: got %q, want %q", key, got, val)
+					return
+				}
+				// Non-KeysOnly queries recurse into a value fetch per
+				// result; this is what used to deadlock against the old
+				// single mutex.
+				rs, err := ds.Query(ctx, dsq.Query{Prefix: key.String()})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := rs.Rest(); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	t.Logf("%d workers x %d keys of Put/Get/Query took %s", workers, keysPerWorker, time.Since(start))
+
+	rs, err := ds.Query(ctx, dsq.Query{Prefix: "/concurrent/", KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := rs.Rest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != workers*keysPerWorker {
+		t.Errorf("got %d keys, want %d", len(all), workers*keysPerWorker)
+	}
+
+	for w := 0; w < workers; w++ {
+		for i := 0; i < keysPerWorker; i++ {
+			key := datastore.NewKey("/concurrent/" + strconv.Itoa(w) + "/" + strconv.Itoa(i))
+			if err := ds.Delete(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.Background()
+	ds, err := newOrAbort(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ds.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range testcases {
+		if err := b.Put(ctx, datastore.NewKey(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range testcases {
+		got, err := ds.Get(ctx, datastore.NewKey(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != v {
+			t.Errorf("%s values differ: %s != %s", k, v, got)
+		}
+	}
+
+	b, err = ds.Batch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range testcases {
+		if err := b.Delete(ctx, datastore.NewKey(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := b.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestPutGetDeleteEmpty(t *testing.T) {
+	ctx := context.Background()
 	ds, err := newOrAbort(t)
 	if err != nil {
 		t.Fatal(err)
 	}
 	key, val := datastore.NewKey("empty"), []byte{}
-	err = ds.Put(key, val)
+	err = ds.Put(ctx, key, val)
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = ds.Get(key)
+	_, err = ds.Get(ctx, key)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = ds.Delete(key)
+	err = ds.Delete(ctx, key)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestDelete(t *testing.T) {
+	ctx := context.Background()
 	ds, err := newOrAbort(t)
 	if err != nil {
 		t.Fatal(err)
 	}
 	key, val := datastore.NewKey("foo"), []byte("bar")
-	err = ds.Put(key, val)
+	err = ds.Put(ctx, key, val)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = ds.Delete(key)
+	err = ds.Delete(ctx, key)
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = ds.Get(key)
+	_, err = ds.Get(ctx, key)
 	if err == nil {
 		t.Fatal(err)
 	}
 }
 
 func TestGetSize(t *testing.T) {
+	ctx := context.Background()
 	ds, err := newOrAbort(t)
 	if err != nil {
 		t.Fatal(err)
 	}
 	key, val := datastore.NewKey("/foo"), []byte("bar")
-	err = ds.Put(key, val)
+	err = ds.Put(ctx, key, val)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	size, err := ds.GetSize(key)
+	size, err := ds.GetSize(ctx, key)
 	if err != nil {
 		t.Fatal(err)
 	}
 	if size != len("bar") {
 		t.Fail()
 	}
-	err = ds.Delete(key)
+	err = ds.Delete(ctx, key)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
-func newOrAbort(t *testing.T) (*Datastore, error) {
+func newOrAbort(t testing.TB) (*Datastore, error) {
 	confPath := os.Getenv("CEPH_CONF")
 	pool := os.Getenv("CEPH_POOL")
 	ds, err := NewDatastore(confPath, pool)
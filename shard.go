@@ -0,0 +1,129 @@
+package rados
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// shardObject is the well-known object name under the pool's default
+// namespace that records the ShardFunc a sharded Datastore was opened
+// with, mirroring the SHARDING file go-ds-flatfs keeps at the root of a
+// flatfs repo.
+const shardObject = "SHARDING"
+
+const shardConfigPrefix = "/repo/rados/shard/"
+
+// ShardFunc computes the RADOS namespace a key is stored under, given the
+// key with its leading "/" stripped. It is used to spread keys across
+// namespaces of a single pool so hot workloads aren't all landing on the same
+// placement groups.
+type ShardFunc func(noslash string) string
+
+// ShardIdV1 names a ShardFunc so that it can be persisted alongside the
+// pool and validated against on subsequent opens, exactly like
+// go-ds-flatfs's ShardIdV1.
+type ShardIdV1 struct {
+	funName string
+	param   int
+	fun     ShardFunc
+}
+
+// String returns the canonical, persistable representation of the shard
+// function, e.g. "/repo/rados/shard/v1/next-to-last/2".
+func (f *ShardIdV1) String() string {
+	return fmt.Sprintf("%sv1/%s/%d", shardConfigPrefix, f.funName, f.param)
+}
+
+// Func returns the underlying ShardFunc.
+func (f *ShardIdV1) Func() ShardFunc {
+	return f.fun
+}
+
+// Prefix shards by the first prefixLen characters of the key.
+func Prefix(prefixLen int) *ShardIdV1 {
+	padding := strings.Repeat("_", prefixLen)
+	return &ShardIdV1{
+		funName: "prefix",
+		param:   prefixLen,
+		fun: func(noslash string) string {
+			return (noslash + padding)[:prefixLen]
+		},
+	}
+}
+
+// Suffix shards by the last suffixLen characters of the key.
+func Suffix(suffixLen int) *ShardIdV1 {
+	padding := strings.Repeat("_", suffixLen)
+	return &ShardIdV1{
+		funName: "suffix",
+		param:   suffixLen,
+		fun: func(noslash string) string {
+			str := padding + noslash
+			return str[len(str)-suffixLen:]
+		},
+	}
+}
+
+// NextToLast shards by the suffixLen characters preceding the last
+// character of the key. For multihash-derived keys this avoids clumping
+// on a shared trailing checksum byte, the same trick go-ds-flatfs's
+// IPFS_DEF_SHARD default uses.
+func NextToLast(suffixLen int) *ShardIdV1 {
+	padding := strings.Repeat("_", suffixLen+1)
+	return &ShardIdV1{
+		funName: "next-to-last",
+		param:   suffixLen,
+		fun: func(noslash string) string {
+			str := padding + noslash
+			offset := len(str) - suffixLen - 1
+			return str[offset : offset+suffixLen]
+		},
+	}
+}
+
+// ParseShardFunc parses the canonical representation produced by
+// ShardIdV1.String back into a ShardIdV1.
+func ParseShardFunc(str string) (*ShardIdV1, error) {
+	str = strings.TrimSpace(str)
+
+	trimmed := strings.TrimPrefix(str, shardConfigPrefix)
+	if str == trimmed {
+		return nil, fmt.Errorf("invalid or no prefix in shard identifier: %s", str)
+	}
+	str = trimmed
+
+	parts := strings.Split(str, "/")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid shard identifier: %s", str)
+	}
+
+	if parts[0] != "v1" {
+		return nil, fmt.Errorf("expected 'v1' for version string got: %s", parts[0])
+	}
+
+	param, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid parameter: %v", err)
+	}
+
+	switch parts[1] {
+	case "prefix":
+		return Prefix(param), nil
+	case "suffix":
+		return Suffix(param), nil
+	case "next-to-last":
+		return NextToLast(param), nil
+	default:
+		return nil, fmt.Errorf("expected 'prefix', 'suffix' or 'next-to-last' got: %s", parts[1])
+	}
+}
+
+// namespace returns the RADOS namespace key should be stored under. An
+// unsharded Datastore always uses the default namespace ("").
+func (ds *Datastore) namespace(noslash string) string {
+	if ds.shard == nil {
+		return ""
+	}
+	return ds.shard.fun(noslash)
+}
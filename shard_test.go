@@ -0,0 +1,123 @@
+package rados
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	datastore "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+func TestShardFuncRoundTrip(t *testing.T) {
+	for _, shard := range []*ShardIdV1{Prefix(2), Suffix(2), NextToLast(2)} {
+		parsed, err := ParseShardFunc(shard.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.String() != shard.String() {
+			t.Errorf("round trip mismatch: %s != %s", parsed.String(), shard.String())
+		}
+	}
+}
+
+func TestNextToLast(t *testing.T) {
+	fn := NextToLast(2).Func()
+	cases := map[string]string{
+		"foobar": "ba",
+		"ab":     "_a",
+		"a":      "__",
+	}
+	for in, want := range cases {
+		if got := fn(in); got != want {
+			t.Errorf("NextToLast(2)(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParseShardFuncInvalid(t *testing.T) {
+	if _, err := ParseShardFunc("not-a-shard-id"); err == nil {
+		t.Fatal("expected an error for an invalid shard identifier")
+	}
+}
+
+// newShardedOrAbort mirrors newOrAbort, but opens a sharded Datastore
+// against the same test pool.
+func newShardedOrAbort(t testing.TB, shard *ShardIdV1) (*Datastore, error) {
+	confPath := os.Getenv("CEPH_CONF")
+	pool := os.Getenv("CEPH_POOL")
+	ds, err := NewShardedDatastore(confPath, pool, shard)
+	if err != nil {
+		t.Logf("could not open a sharded RADOS datastore: %v", err)
+		t.SkipNow()
+	}
+	return ds, err
+}
+
+// TestNewShardedDatastorePersistsAndEnforcesConfig checks the request's
+// central contract: the first sharded open on a pool persists its
+// ShardFunc to the SHARDING object, and a later open with a different
+// ShardFunc is refused rather than silently reinterpreting keys under the
+// wrong scheme.
+func TestNewShardedDatastorePersistsAndEnforcesConfig(t *testing.T) {
+	ds, err := newShardedOrAbort(t, Prefix(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Shutdown()
+
+	if _, err := NewShardedDatastore(ds.confPath, ds.pool, Suffix(2)); err == nil {
+		t.Fatal("expected an error reopening the pool with a mismatched ShardFunc")
+	}
+
+	reopened, err := NewShardedDatastore(ds.confPath, ds.pool, Prefix(2))
+	if err != nil {
+		t.Fatalf("reopening with the same ShardFunc should succeed: %v", err)
+	}
+	reopened.Shutdown()
+}
+
+// TestShardedDatastorePutQueryAcrossNamespaces round-trips keys that land
+// in different RADOS namespaces under Prefix(1) sharding, and checks that
+// Query fans out across all of them rather than only the default
+// namespace.
+func TestShardedDatastorePutQueryAcrossNamespaces(t *testing.T) {
+	ctx := context.Background()
+	ds, err := newShardedOrAbort(t, Prefix(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Shutdown()
+
+	cases := map[string]string{
+		"/a/1": "a1",
+		"/b/2": "b2",
+		"/c/3": "c3",
+	}
+	for k, v := range cases {
+		if err := ds.Put(ctx, datastore.NewKey(k), []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for k := range cases {
+			ds.Delete(ctx, datastore.NewKey(k))
+		}
+	}()
+
+	for k, v := range cases {
+		got, err := ds.Get(ctx, datastore.NewKey(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != v {
+			t.Errorf("%s: got %q, want %q", k, got, v)
+		}
+	}
+
+	rs, err := ds.Query(ctx, dsq.Query{Prefix: "/", KeysOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMatches(t, []string{"/a/1", "/b/2", "/c/3"}, rs)
+}